@@ -2,11 +2,14 @@ package main
 
 import (
 	"fmt"
+	"hash/fnv"
 	"math/rand"
+	"runtime"
 	"strconv"
 	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // golang intXXX, map, bool or pointer to anything assignments are atomic as of go1.15. This is not guaranteed by language spec & may change in future.
@@ -17,75 +20,1549 @@ import (
 // ************************** R E S U L T **************************
 // Our efficient map is about 1%-2% efficient than AtomicMap which is 2%-5% efficient than sync.SyncMap
 
-//Mapper is common map interface of all benchmarked implementations.
-type Mapper interface {
-	Get(key string) (interface{}, bool)
-	Put(key string, val interface{})
+//Mapper is common map interface of all benchmarked implementations. It is
+//generic over key and value so callers don't pay interface{} boxing or
+//per-Get type assertions on the hot path.
+type Mapper[K comparable, V any] interface {
+	Get(key K) (V, bool)
+	Put(key K, val V)
+	// LoadOrStore returns the existing value for key if present, otherwise stores
+	// and returns val. loaded is true if the existing value was returned, false
+	// if val was stored.
+	LoadOrStore(key K, val V) (actual V, loaded bool)
+	// Delete removes key, if present.
+	Delete(key K)
+	// Range calls f sequentially for each key and value in the map. Range stops
+	// if f returns false. Only AtomicMap and EfficientMap iterate one snapshot
+	// taken at the start of the call; the other implementations may or may not
+	// reflect writes made while Range runs.
+	Range(f func(key K, val V) bool)
+	// UpdateOrStore atomically computes the new value for key from its current
+	// value (and whether it existed) via f, stores it, and returns it.
+	UpdateOrStore(key K, f func(old V, existed bool) V) V
 }
 
 // ************************** I M P L M E N T A T I O N S **************************
 
 //SyncMap is implemented using standard sync.Map. No CopyOnWrite
-type SyncMap struct {
-	m sync.Map
+type SyncMap[K comparable, V any] struct {
+	m     sync.Map
+	mutex sync.Mutex // guards Put/LoadOrStore/Delete/UpdateOrStore against each other
 }
 
-func NewSyncMap() *SyncMap { return &SyncMap{sync.Map{}} }
-func (sm *SyncMap) Get(key string) (interface{}, bool) {
-	return sm.m.Load(key)
+func NewSyncMap[K comparable, V any]() *SyncMap[K, V] { return &SyncMap[K, V]{} }
+func (sm *SyncMap[K, V]) Get(key K) (V, bool) {
+	v, ok := sm.m.Load(key)
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	return v.(V), true
 }
-func (sm *SyncMap) Put(key string, val interface{}) {
+func (sm *SyncMap[K, V]) Put(key K, val V) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
 	sm.m.Store(key, val)
 }
+func (sm *SyncMap[K, V]) LoadOrStore(key K, val V) (V, bool) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	actual, loaded := sm.m.LoadOrStore(key, val)
+	return actual.(V), loaded
+}
+func (sm *SyncMap[K, V]) Delete(key K) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.m.Delete(key)
+}
+func (sm *SyncMap[K, V]) Range(f func(key K, val V) bool) {
+	sm.m.Range(func(k, v interface{}) bool {
+		return f(k.(K), v.(V))
+	})
+}
+func (sm *SyncMap[K, V]) UpdateOrStore(key K, f func(old V, existed bool) V) V {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	old, existed := sm.Get(key)
+	newVal := f(old, existed)
+	sm.m.Store(key, newVal)
+	return newVal
+}
 
 //AtomicMap is CopyOnWrite map implemented using atomic.Value
-type AtomicMap struct {
+type AtomicMap[K comparable, V any] struct {
 	av    *atomic.Value
 	mutex sync.Mutex
 }
 
-func NewAtomicMap() *AtomicMap {
+func NewAtomicMap[K comparable, V any]() *AtomicMap[K, V] {
 	av := &atomic.Value{}
-	av.Store(map[string]interface{}{})
-	return &AtomicMap{av: av}
+	av.Store(map[K]V{})
+	return &AtomicMap[K, V]{av: av}
 }
-func (am *AtomicMap) Get(key string) (interface{}, bool) {
-	ret, ok := am.av.Load().(map[string]interface{})[key]
+func (am *AtomicMap[K, V]) Get(key K) (V, bool) {
+	ret, ok := am.av.Load().(map[K]V)[key]
 	return ret, ok
 }
-func (am *AtomicMap) Put(key string, val interface{}) {
+func (am *AtomicMap[K, V]) Put(key K, val V) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	m := am.av.Load().(map[K]V)
+	copy := make(map[K]V, len(m))
+	for k, v := range m {
+		copy[k] = v
+	}
+	copy[key] = val
+	am.av.Store(copy)
+}
+func (am *AtomicMap[K, V]) LoadOrStore(key K, val V) (V, bool) {
 	am.mutex.Lock()
 	defer am.mutex.Unlock()
-	m := am.av.Load().(map[string]interface{})
-	copy := make(map[string]interface{}, len(m))
+	m := am.av.Load().(map[K]V)
+	if actual, ok := m[key]; ok {
+		return actual, true
+	}
+	copy := make(map[K]V, len(m)+1)
 	for k, v := range m {
 		copy[k] = v
 	}
 	copy[key] = val
 	am.av.Store(copy)
+	return val, false
+}
+func (am *AtomicMap[K, V]) Delete(key K) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	m := am.av.Load().(map[K]V)
+	if _, ok := m[key]; !ok {
+		return
+	}
+	copy := make(map[K]V, len(m)-1)
+	for k, v := range m {
+		if k != key {
+			copy[k] = v
+		}
+	}
+	am.av.Store(copy)
+}
+func (am *AtomicMap[K, V]) Range(f func(key K, val V) bool) {
+	m := am.av.Load().(map[K]V)
+	for k, v := range m {
+		if !f(k, v) {
+			return
+		}
+	}
+}
+func (am *AtomicMap[K, V]) UpdateOrStore(key K, f func(old V, existed bool) V) V {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	m := am.av.Load().(map[K]V)
+	old, existed := m[key]
+	newVal := f(old, existed)
+	copy := make(map[K]V, len(m)+1)
+	for k, v := range m {
+		copy[k] = v
+	}
+	copy[key] = newVal
+	am.av.Store(copy)
+	return newVal
+}
+
+// Snapshot returns the currently published map as a read-only view in O(1);
+// AtomicMap's writers only ever store a fresh copy and never mutate a
+// published map in place, so no copy is needed. Callers must not write to
+// the returned map.
+func (am *AtomicMap[K, V]) Snapshot() map[K]V {
+	return am.av.Load().(map[K]V)
 }
 
-// EfficientMap is implemented exploiting the fact that map assignments are atomic (against language spec. -race flag will complain)
-// CopyOnWrite.
-type EfficientMap struct {
-	m     map[string]interface{} // Keep plain map
+// EfficientMap is a CopyOnWrite map. The published map is held behind an
+// atomic.Pointer rather than a plain field assignment, so -race no longer
+// complains about the publish on Put; see Snapshot for the payoff.
+type EfficientMap[K comparable, V any] struct {
+	m     atomic.Pointer[map[K]V]
 	mutex sync.Mutex
 }
 
-func NewEfficientMap() *EfficientMap { return &EfficientMap{m: map[string]interface{}{}} }
-func (em *EfficientMap) Get(key string) (interface{}, bool) {
-	ret, ok := em.m[key] // -race would complain !
+func NewEfficientMap[K comparable, V any]() *EfficientMap[K, V] {
+	em := &EfficientMap[K, V]{}
+	m := map[K]V{}
+	em.m.Store(&m)
+	return em
+}
+func (em *EfficientMap[K, V]) Get(key K) (V, bool) {
+	ret, ok := (*em.m.Load())[key]
 	return ret, ok
 }
-func (em *EfficientMap) Put(key string, val interface{}) {
+func (em *EfficientMap[K, V]) Put(key K, val V) {
 	em.mutex.Lock()
 	defer em.mutex.Unlock()
-	copy := make(map[string]interface{}, len(em.m))
-	for k, v := range em.m {
+	old := *em.m.Load()
+	copy := make(map[K]V, len(old))
+	for k, v := range old {
 		copy[k] = v
 	}
 	copy[key] = val
-	em.m = copy // -race would complain !
+	em.m.Store(&copy)
+}
+func (em *EfficientMap[K, V]) LoadOrStore(key K, val V) (V, bool) {
+	em.mutex.Lock()
+	defer em.mutex.Unlock()
+	old := *em.m.Load()
+	if actual, ok := old[key]; ok {
+		return actual, true
+	}
+	copy := make(map[K]V, len(old)+1)
+	for k, v := range old {
+		copy[k] = v
+	}
+	copy[key] = val
+	em.m.Store(&copy)
+	return val, false
+}
+func (em *EfficientMap[K, V]) Delete(key K) {
+	em.mutex.Lock()
+	defer em.mutex.Unlock()
+	old := *em.m.Load()
+	if _, ok := old[key]; !ok {
+		return
+	}
+	copy := make(map[K]V, len(old)-1)
+	for k, v := range old {
+		if k != key {
+			copy[k] = v
+		}
+	}
+	em.m.Store(&copy)
+}
+func (em *EfficientMap[K, V]) Range(f func(key K, val V) bool) {
+	for k, v := range *em.m.Load() {
+		if !f(k, v) {
+			return
+		}
+	}
+}
+func (em *EfficientMap[K, V]) UpdateOrStore(key K, f func(old V, existed bool) V) V {
+	em.mutex.Lock()
+	defer em.mutex.Unlock()
+	old := *em.m.Load()
+	oldVal, existed := old[key]
+	newVal := f(oldVal, existed)
+	copy := make(map[K]V, len(old)+1)
+	for k, v := range old {
+		copy[k] = v
+	}
+	copy[key] = newVal
+	em.m.Store(&copy)
+	return newVal
+}
+
+// Snapshot returns the currently published map as a read-only view. Since
+// EfficientMap only ever replaces its published map (never mutates it in
+// place after publication), Snapshot can hand back the atomically-loaded
+// pointer directly in O(1) instead of copying it. Callers must not write to
+// the returned map.
+func (em *EfficientMap[K, V]) Snapshot() map[K]V {
+	return *em.m.Load()
+}
+
+// ShardedEfficientMap partitions keys across N shards, each an independent
+// CopyOnWrite map guarded by its own mutex and published via atomic.Pointer.
+// A single EfficientMap serializes every writer against a copy of the whole
+// map; sharding parallelizes writers and shrinks each copy to roughly
+// size/shards entries.
+type ShardedEfficientMap[K comparable, V any] struct {
+	hash   func(key K) uint32
+	shards []*emShard[K, V]
+}
+
+type emShard[K comparable, V any] struct {
+	m     atomic.Pointer[map[K]V]
+	mutex sync.Mutex
+}
+
+// NewShardedEfficientMap creates a ShardedEfficientMap with the given number
+// of shards, using hash to pick a key's shard. shards <= 0 defaults to
+// runtime.GOMAXPROCS(0).
+func NewShardedEfficientMap[K comparable, V any](shards int, hash func(key K) uint32) *ShardedEfficientMap[K, V] {
+	if shards <= 0 {
+		shards = runtime.GOMAXPROCS(0)
+	}
+	sem := &ShardedEfficientMap[K, V]{hash: hash, shards: make([]*emShard[K, V], shards)}
+	for i := range sem.shards {
+		shard := &emShard[K, V]{}
+		m := map[K]V{}
+		shard.m.Store(&m)
+		sem.shards[i] = shard
+	}
+	return sem
+}
+
+func (sem *ShardedEfficientMap[K, V]) shardFor(key K) *emShard[K, V] {
+	return sem.shards[sem.hash(key)%uint32(len(sem.shards))]
+}
+
+func (sem *ShardedEfficientMap[K, V]) Get(key K) (V, bool) {
+	shard := sem.shardFor(key)
+	ret, ok := (*shard.m.Load())[key]
+	return ret, ok
+}
+
+func (sem *ShardedEfficientMap[K, V]) Put(key K, val V) {
+	shard := sem.shardFor(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	old := *shard.m.Load()
+	copy := make(map[K]V, len(old))
+	for k, v := range old {
+		copy[k] = v
+	}
+	copy[key] = val
+	shard.m.Store(&copy)
+}
+
+func (sem *ShardedEfficientMap[K, V]) LoadOrStore(key K, val V) (V, bool) {
+	shard := sem.shardFor(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	old := *shard.m.Load()
+	if actual, ok := old[key]; ok {
+		return actual, true
+	}
+	copy := make(map[K]V, len(old)+1)
+	for k, v := range old {
+		copy[k] = v
+	}
+	copy[key] = val
+	shard.m.Store(&copy)
+	return val, false
+}
+
+func (sem *ShardedEfficientMap[K, V]) Delete(key K) {
+	shard := sem.shardFor(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	old := *shard.m.Load()
+	if _, ok := old[key]; !ok {
+		return
+	}
+	copy := make(map[K]V, len(old)-1)
+	for k, v := range old {
+		if k != key {
+			copy[k] = v
+		}
+	}
+	shard.m.Store(&copy)
+}
+
+func (sem *ShardedEfficientMap[K, V]) Range(f func(key K, val V) bool) {
+	for _, shard := range sem.shards {
+		m := *shard.m.Load()
+		for k, v := range m {
+			if !f(k, v) {
+				return
+			}
+		}
+	}
+}
+
+func (sem *ShardedEfficientMap[K, V]) UpdateOrStore(key K, f func(old V, existed bool) V) V {
+	shard := sem.shardFor(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	old := *shard.m.Load()
+	oldVal, existed := old[key]
+	newVal := f(oldVal, existed)
+	copy := make(map[K]V, len(old)+1)
+	for k, v := range old {
+		copy[k] = v
+	}
+	copy[key] = newVal
+	shard.m.Store(&copy)
+	return newVal
+}
+
+// AtomicPtrMap is modeled on gvisor's generic AtomicPtrMap: an open-addressed
+// table whose slots hold a fixed key plus a value published via
+// atomic.Pointer[V]. Load never takes mutex, so it does not serialize against
+// writers or copy the whole map the way EfficientMap's Put does; Store,
+// Delete and friends take mutex and, past a 50% load factor, rehash into a
+// freshly allocated table that Load transparently picks up.
+type AtomicPtrMap[K comparable, V any] struct {
+	hash     func(key K) uint32
+	table    atomic.Pointer[[]atomic.Pointer[atomicPtrMapEntry[K, V]]]
+	mutex    sync.Mutex // guards Store/Delete/LoadOrStore/UpdateOrStore/grow
+	count    int        // live (non-tombstone) entries; guarded by mutex
+	occupied int        // claimed slots, live or tombstoned; guarded by mutex
+}
+
+type atomicPtrMapEntry[K comparable, V any] struct {
+	key K
+	val atomic.Pointer[V] // nil means key was deleted; slot stays in the probe chain
+}
+
+const atomicPtrMapInitialSlots = 16 // must stay a power of two
+
+// NewAtomicPtrMap creates an AtomicPtrMap that uses hash to place keys.
+func NewAtomicPtrMap[K comparable, V any](hash func(key K) uint32) *AtomicPtrMap[K, V] {
+	m := &AtomicPtrMap[K, V]{hash: hash}
+	table := make([]atomic.Pointer[atomicPtrMapEntry[K, V]], atomicPtrMapInitialSlots)
+	m.table.Store(&table)
+	return m
+}
+
+// Load is the wait-free read path: it never blocks on mutex and never copies
+// the table.
+func (m *AtomicPtrMap[K, V]) Load(key K) (*V, bool) {
+	table := *m.table.Load()
+	mask := uint32(len(table) - 1)
+	h := m.hash(key)
+	for i := uint32(0); i < uint32(len(table)); i++ {
+		e := table[(h+i)&mask].Load()
+		if e == nil {
+			return nil, false
+		}
+		if e.key == key {
+			v := e.val.Load()
+			return v, v != nil
+		}
+	}
+	return nil, false
+}
+
+func (m *AtomicPtrMap[K, V]) Get(key K) (V, bool) {
+	v, ok := m.Load(key)
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	return *v, true
+}
+
+// Store publishes val for key, growing the table first if needed.
+func (m *AtomicPtrMap[K, V]) Store(key K, val V) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.growLocked()
+	table := *m.table.Load()
+	mask := uint32(len(table) - 1)
+	h := m.hash(key)
+	for i := uint32(0); i < uint32(len(table)); i++ {
+		slot := &table[(h+i)&mask]
+		e := slot.Load()
+		if e == nil {
+			newEntry := &atomicPtrMapEntry[K, V]{key: key}
+			newEntry.val.Store(&val)
+			slot.Store(newEntry)
+			m.count++
+			m.occupied++
+			return
+		}
+		if e.key == key {
+			if e.val.Load() == nil {
+				m.count++
+			}
+			e.val.Store(&val)
+			return
+		}
+	}
+}
+
+func (m *AtomicPtrMap[K, V]) Put(key K, val V) { m.Store(key, val) }
+
+func (m *AtomicPtrMap[K, V]) LoadOrStore(key K, val V) (V, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.growLocked()
+	table := *m.table.Load()
+	mask := uint32(len(table) - 1)
+	h := m.hash(key)
+	for i := uint32(0); i < uint32(len(table)); i++ {
+		slot := &table[(h+i)&mask]
+		e := slot.Load()
+		if e == nil {
+			newEntry := &atomicPtrMapEntry[K, V]{key: key}
+			newEntry.val.Store(&val)
+			slot.Store(newEntry)
+			m.count++
+			m.occupied++
+			return val, false
+		}
+		if e.key == key {
+			if v := e.val.Load(); v != nil {
+				return *v, true
+			}
+			e.val.Store(&val)
+			m.count++
+			return val, false
+		}
+	}
+	panic("efficientmap: AtomicPtrMap table unexpectedly full")
+}
+
+func (m *AtomicPtrMap[K, V]) Delete(key K) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	table := *m.table.Load()
+	mask := uint32(len(table) - 1)
+	h := m.hash(key)
+	for i := uint32(0); i < uint32(len(table)); i++ {
+		e := table[(h+i)&mask].Load()
+		if e == nil {
+			return
+		}
+		if e.key == key {
+			if e.val.Load() != nil {
+				e.val.Store(nil)
+				m.count--
+			}
+			return
+		}
+	}
+}
+
+func (m *AtomicPtrMap[K, V]) Range(f func(key K, val V) bool) {
+	table := *m.table.Load()
+	for i := range table {
+		e := table[i].Load()
+		if e == nil {
+			continue
+		}
+		if v := e.val.Load(); v != nil {
+			if !f(e.key, *v) {
+				return
+			}
+		}
+	}
+}
+
+func (m *AtomicPtrMap[K, V]) UpdateOrStore(key K, f func(old V, existed bool) V) V {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.growLocked()
+	table := *m.table.Load()
+	mask := uint32(len(table) - 1)
+	h := m.hash(key)
+	for i := uint32(0); i < uint32(len(table)); i++ {
+		slot := &table[(h+i)&mask]
+		e := slot.Load()
+		if e == nil {
+			var zero V
+			newVal := f(zero, false)
+			newEntry := &atomicPtrMapEntry[K, V]{key: key}
+			newEntry.val.Store(&newVal)
+			slot.Store(newEntry)
+			m.count++
+			m.occupied++
+			return newVal
+		}
+		if e.key == key {
+			old := e.val.Load()
+			var oldVal V
+			existed := old != nil
+			if existed {
+				oldVal = *old
+			} else {
+				m.count++
+			}
+			newVal := f(oldVal, existed)
+			e.val.Store(&newVal)
+			return newVal
+		}
+	}
+	panic("efficientmap: AtomicPtrMap table unexpectedly full")
+}
+
+// growLocked doubles the table once the load factor crosses 50%, rehashing
+// live entries into fresh slots while reusing each entry's existing *V
+// pointer, so a concurrent lock-free Load racing the grow never observes a
+// torn value.
+//
+// The trigger is occupied (live + tombstoned slots), not count (live
+// entries only): a store/delete-heavy workload that never holds many live
+// entries at once would otherwise keep count near zero forever, leaving the
+// table to fill up with tombstones until the probe loops in Store/
+// LoadOrStore/UpdateOrStore run out of slots.
+func (m *AtomicPtrMap[K, V]) growLocked() {
+	table := *m.table.Load()
+	if m.occupied*2 < len(table) {
+		return
+	}
+	newTable := make([]atomic.Pointer[atomicPtrMapEntry[K, V]], len(table)*2)
+	mask := uint32(len(newTable) - 1)
+	for i := range table {
+		e := table[i].Load()
+		if e == nil || e.val.Load() == nil {
+			continue
+		}
+		h := m.hash(e.key)
+		for j := uint32(0); j < uint32(len(newTable)); j++ {
+			slot := &newTable[(h+j)&mask]
+			if slot.Load() == nil {
+				slot.Store(e)
+				break
+			}
+		}
+	}
+	m.table.Store(&newTable)
+	m.occupied = m.count // tombstones were dropped; only live entries were rehashed
+}
+
+// AtomicPtrMapSharded partitions an AtomicPtrMap across N shards, the same
+// way ShardedEfficientMap partitions EfficientMap.
+type AtomicPtrMapSharded[K comparable, V any] struct {
+	hash   func(key K) uint32
+	shards []*AtomicPtrMap[K, V]
+}
+
+func NewAtomicPtrMapSharded[K comparable, V any](shards int, hash func(key K) uint32) *AtomicPtrMapSharded[K, V] {
+	if shards <= 0 {
+		shards = runtime.GOMAXPROCS(0)
+	}
+	sm := &AtomicPtrMapSharded[K, V]{hash: hash, shards: make([]*AtomicPtrMap[K, V], shards)}
+	for i := range sm.shards {
+		sm.shards[i] = NewAtomicPtrMap[K, V](hash)
+	}
+	return sm
+}
+
+func (sm *AtomicPtrMapSharded[K, V]) shardFor(key K) *AtomicPtrMap[K, V] {
+	return sm.shards[sm.hash(key)%uint32(len(sm.shards))]
+}
+
+func (sm *AtomicPtrMapSharded[K, V]) Get(key K) (V, bool) { return sm.shardFor(key).Get(key) }
+func (sm *AtomicPtrMapSharded[K, V]) Put(key K, val V)    { sm.shardFor(key).Put(key, val) }
+func (sm *AtomicPtrMapSharded[K, V]) LoadOrStore(key K, val V) (V, bool) {
+	return sm.shardFor(key).LoadOrStore(key, val)
+}
+func (sm *AtomicPtrMapSharded[K, V]) Delete(key K) { sm.shardFor(key).Delete(key) }
+func (sm *AtomicPtrMapSharded[K, V]) Range(f func(key K, val V) bool) {
+	for _, shard := range sm.shards {
+		done := false
+		shard.Range(func(k K, v V) bool {
+			if !f(k, v) {
+				done = true
+				return false
+			}
+			return true
+		})
+		if done {
+			return
+		}
+	}
+}
+func (sm *AtomicPtrMapSharded[K, V]) UpdateOrStore(key K, f func(old V, existed bool) V) V {
+	return sm.shardFor(key).UpdateOrStore(key, f)
+}
+
+// FNVHashString is an FNV-1a hash function for string keys, used to place keys
+// in ShardedEfficientMap and AtomicPtrMap(Sharded) in the benchmarks below.
+func FNVHashString(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// HybridMap mirrors sync.Map's two-map design: a read-only map published via
+// atomic.Pointer serves the lock-free fast path, while a mutex-guarded dirty
+// map absorbs recent writes. Once misses against read reach len(dirty),
+// dirty is promoted into a new read and cleared. This keeps Put amortized
+// O(1) instead of the full-copy O(N) EfficientMap pays on every write, while
+// preserving lock-free reads for keys already promoted into read.
+type HybridMap[K comparable, V any] struct {
+	expunged *V // sentinel identity marking an entry deleted & dropped from dirty
+
+	read   atomic.Pointer[hybridReadOnly[K, V]]
+	mutex  sync.Mutex
+	dirty  map[K]*hybridEntry[V] // nil until the first write misses read
+	misses int                   // guarded by mutex
+}
+
+type hybridReadOnly[K comparable, V any] struct {
+	m       map[K]*hybridEntry[V]
+	amended bool // true if dirty holds keys not in m
+}
+
+// hybridEntry holds the value for one key. p == nil means the key was
+// deleted but the entry is still mirrored in dirty; p == the map's expunged
+// sentinel means the key was deleted and, after a dirtyLocked rebuild,
+// dropped from dirty entirely.
+type hybridEntry[V any] struct {
+	p atomic.Pointer[V]
+}
+
+func newHybridEntry[V any](val V) *hybridEntry[V] {
+	e := &hybridEntry[V]{}
+	e.p.Store(&val)
+	return e
+}
+
+func (e *hybridEntry[V]) load(expunged *V) (V, bool) {
+	p := e.p.Load()
+	if p == nil || p == expunged {
+		var zero V
+		return zero, false
+	}
+	return *p, true
+}
+
+func (e *hybridEntry[V]) tryStore(expunged *V, val V) bool {
+	for {
+		p := e.p.Load()
+		if p == expunged {
+			return false
+		}
+		if e.p.CompareAndSwap(p, &val) {
+			return true
+		}
+	}
+}
+
+func (e *hybridEntry[V]) tryLoadOrStore(expunged *V, val V) (actual V, loaded, ok bool) {
+	p := e.p.Load()
+	if p == expunged {
+		return actual, false, false
+	}
+	if p != nil {
+		return *p, true, true
+	}
+	for {
+		if e.p.CompareAndSwap(nil, &val) {
+			return val, false, true
+		}
+		p = e.p.Load()
+		if p == expunged {
+			return actual, false, false
+		}
+		if p != nil {
+			return *p, true, true
+		}
+	}
+}
+
+func (e *hybridEntry[V]) delete(expunged *V) (hadValue bool) {
+	for {
+		p := e.p.Load()
+		if p == nil || p == expunged {
+			return false
+		}
+		if e.p.CompareAndSwap(p, nil) {
+			return true
+		}
+	}
+}
+
+func (e *hybridEntry[V]) unexpungeLocked(expunged *V) (wasExpunged bool) {
+	return e.p.CompareAndSwap(expunged, nil)
+}
+
+func (e *hybridEntry[V]) storeLocked(val V) {
+	e.p.Store(&val)
+}
+
+func (e *hybridEntry[V]) tryExpungeLocked(expunged *V) (isExpunged bool) {
+	p := e.p.Load()
+	for p == nil {
+		if e.p.CompareAndSwap(nil, expunged) {
+			return true
+		}
+		p = e.p.Load()
+	}
+	return p == expunged
+}
+
+func NewHybridMap[K comparable, V any]() *HybridMap[K, V] {
+	h := &HybridMap[K, V]{expunged: new(V)}
+	h.read.Store(&hybridReadOnly[K, V]{})
+	return h
+}
+
+func (h *HybridMap[K, V]) loadReadOnly() *hybridReadOnly[K, V] {
+	read := h.read.Load()
+	if read == nil {
+		return &hybridReadOnly[K, V]{}
+	}
+	return read
+}
+
+func (h *HybridMap[K, V]) Get(key K) (V, bool) {
+	read := h.loadReadOnly()
+	e, ok := read.m[key]
+	if !ok && read.amended {
+		h.mutex.Lock()
+		read = h.loadReadOnly()
+		e, ok = read.m[key]
+		if !ok && read.amended {
+			e, ok = h.dirty[key]
+			h.missLocked()
+		}
+		h.mutex.Unlock()
+	}
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	return e.load(h.expunged)
+}
+
+func (h *HybridMap[K, V]) Put(key K, val V) {
+	read := h.loadReadOnly()
+	if e, ok := read.m[key]; ok && e.tryStore(h.expunged, val) {
+		return
+	}
+	h.mutex.Lock()
+	read = h.loadReadOnly()
+	if e, ok := read.m[key]; ok {
+		if e.unexpungeLocked(h.expunged) {
+			h.dirty[key] = e
+		}
+		e.storeLocked(val)
+	} else if e, ok := h.dirty[key]; ok {
+		e.storeLocked(val)
+	} else {
+		if !read.amended {
+			h.dirtyLocked()
+			h.read.Store(&hybridReadOnly[K, V]{m: read.m, amended: true})
+		}
+		h.dirty[key] = newHybridEntry(val)
+	}
+	h.mutex.Unlock()
+}
+
+func (h *HybridMap[K, V]) LoadOrStore(key K, val V) (V, bool) {
+	read := h.loadReadOnly()
+	if e, ok := read.m[key]; ok {
+		if actual, loaded, ok2 := e.tryLoadOrStore(h.expunged, val); ok2 {
+			return actual, loaded
+		}
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	read = h.loadReadOnly()
+	if e, ok := read.m[key]; ok {
+		if e.unexpungeLocked(h.expunged) {
+			h.dirty[key] = e
+		}
+		actual, loaded, _ := e.tryLoadOrStore(h.expunged, val)
+		return actual, loaded
+	}
+	if e, ok := h.dirty[key]; ok {
+		actual, loaded, _ := e.tryLoadOrStore(h.expunged, val)
+		h.missLocked()
+		return actual, loaded
+	}
+	if !read.amended {
+		h.dirtyLocked()
+		h.read.Store(&hybridReadOnly[K, V]{m: read.m, amended: true})
+	}
+	h.dirty[key] = newHybridEntry(val)
+	return val, false
+}
+
+func (h *HybridMap[K, V]) Delete(key K) {
+	read := h.loadReadOnly()
+	e, ok := read.m[key]
+	if !ok && read.amended {
+		h.mutex.Lock()
+		read = h.loadReadOnly()
+		e, ok = read.m[key]
+		if !ok && read.amended {
+			e, ok = h.dirty[key]
+			delete(h.dirty, key)
+			// Record a miss regardless of whether the entry was present: this key
+			// takes the slow path until dirty is promoted into read.
+			h.missLocked()
+		}
+		h.mutex.Unlock()
+	}
+	if ok {
+		e.delete(h.expunged)
+	}
+}
+
+func (h *HybridMap[K, V]) Range(f func(key K, val V) bool) {
+	read := h.loadReadOnly()
+	if read.amended {
+		h.mutex.Lock()
+		read = h.loadReadOnly()
+		if read.amended {
+			read = &hybridReadOnly[K, V]{m: h.dirty}
+			h.read.Store(read)
+			h.dirty = nil
+			h.misses = 0
+		}
+		h.mutex.Unlock()
+	}
+	for k, e := range read.m {
+		v, ok := e.load(h.expunged)
+		if !ok {
+			continue
+		}
+		if !f(k, v) {
+			return
+		}
+	}
+}
+
+func (h *HybridMap[K, V]) UpdateOrStore(key K, f func(old V, existed bool) V) V {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	read := h.loadReadOnly()
+	if e, ok := read.m[key]; ok {
+		if e.unexpungeLocked(h.expunged) {
+			h.dirty[key] = e
+		}
+		// Put, LoadOrStore and Delete can change an entry in read without the
+		// mutex, so publish with a CAS and recompute if one of them got in first.
+		for {
+			p := e.p.Load()
+			var old V
+			if p != nil {
+				old = *p
+			}
+			newVal := f(old, p != nil)
+			if e.p.CompareAndSwap(p, &newVal) {
+				return newVal
+			}
+		}
+	}
+	if e, ok := h.dirty[key]; ok {
+		old, existed := e.load(h.expunged)
+		newVal := f(old, existed)
+		e.storeLocked(newVal)
+		h.missLocked()
+		return newVal
+	}
+	var zero V
+	newVal := f(zero, false)
+	if !read.amended {
+		h.dirtyLocked()
+		h.read.Store(&hybridReadOnly[K, V]{m: read.m, amended: true})
+	}
+	h.dirty[key] = newHybridEntry(newVal)
+	return newVal
+}
+
+// dirtyLocked lazily builds dirty from the current read map the first time a
+// write needs it, marking read-only entries with no live value as expunged
+// so they are skipped rather than copied.
+func (h *HybridMap[K, V]) dirtyLocked() {
+	if h.dirty != nil {
+		return
+	}
+	read := h.loadReadOnly()
+	h.dirty = make(map[K]*hybridEntry[V], len(read.m))
+	for k, e := range read.m {
+		if !e.tryExpungeLocked(h.expunged) {
+			h.dirty[k] = e
+		}
+	}
+}
+
+// missLocked records a read miss against the read map; once misses reach
+// len(dirty), dirty is promoted into a fresh read map in O(1).
+func (h *HybridMap[K, V]) missLocked() {
+	h.misses++
+	if h.misses < len(h.dirty) {
+		return
+	}
+	h.read.Store(&hybridReadOnly[K, V]{m: h.dirty})
+	h.dirty = nil
+	h.misses = 0
+}
+
+// ************************** T T L **************************
+// ttlEntry wraps a value with the time it expires at, for the "one visit per
+// 3 minutes per IP" style read-heavy cache described in external doc 11.
+type ttlEntry[V any] struct {
+	val       V
+	expiresAt int64 // UnixNano; zero means the entry never expires
+}
+
+func (e ttlEntry[V]) expired(now int64) bool {
+	return e.expiresAt != 0 && now >= e.expiresAt
+}
+
+// EfficientMapWithTTL adds expiring keys on top of EfficientMap. Get treats
+// an expired entry as absent; a background goroutine started by
+// NewEfficientMapWithTTL periodically rebuilds and publishes the map with
+// expired entries excluded, the same copy-on-write way EfficientMap's own
+// Put does.
+type EfficientMapWithTTL[K comparable, V any] struct {
+	m         *EfficientMap[K, ttlEntry[V]]
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewEfficientMapWithTTL creates an EfficientMapWithTTL and starts its sweep
+// goroutine, which removes expired keys every sweepInterval. Call Close to
+// stop the goroutine.
+func NewEfficientMapWithTTL[K comparable, V any](sweepInterval time.Duration) *EfficientMapWithTTL[K, V] {
+	em := &EfficientMapWithTTL[K, V]{m: NewEfficientMap[K, ttlEntry[V]](), stop: make(chan struct{})}
+	go em.sweepLoop(sweepInterval)
+	return em
+}
+
+func (em *EfficientMapWithTTL[K, V]) Get(key K) (V, bool) {
+	e, ok := em.m.Get(key)
+	if !ok || e.expired(time.Now().UnixNano()) {
+		var zero V
+		return zero, false
+	}
+	return e.val, true
+}
+
+// Put stores val for key with no expiry.
+func (em *EfficientMapWithTTL[K, V]) Put(key K, val V) {
+	em.put(key, ttlEntry[V]{val: val})
+}
+
+// PutWithTTL stores val for key, expiring it after ttl.
+func (em *EfficientMapWithTTL[K, V]) PutWithTTL(key K, val V, ttl time.Duration) {
+	em.put(key, ttlEntry[V]{val: val, expiresAt: time.Now().Add(ttl).UnixNano()})
+}
+
+// put stores entry for key, lazily evicting any other already-expired
+// entries during the same copy-on-write rebuild Put/PutWithTTL already pays
+// for, so expired entries don't linger indefinitely between sweeps (or
+// forever if Close stopped the sweep goroutine).
+func (em *EfficientMapWithTTL[K, V]) put(key K, entry ttlEntry[V]) {
+	now := time.Now().UnixNano()
+	em.m.mutex.Lock()
+	defer em.m.mutex.Unlock()
+	old := *em.m.m.Load()
+	fresh := make(map[K]ttlEntry[V], len(old)+1)
+	for k, e := range old {
+		if k == key || !e.expired(now) {
+			fresh[k] = e
+		}
+	}
+	fresh[key] = entry
+	em.m.m.Store(&fresh)
+}
+
+func (em *EfficientMapWithTTL[K, V]) Delete(key K) { em.m.Delete(key) }
+
+// Close stops the background sweep goroutine.
+func (em *EfficientMapWithTTL[K, V]) Close() {
+	em.closeOnce.Do(func() { close(em.stop) })
+}
+
+func (em *EfficientMapWithTTL[K, V]) sweepLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			em.sweepOnce()
+		case <-em.stop:
+			return
+		}
+	}
+}
+
+// sweepOnce rebuilds and publishes the map with expired entries excluded, in
+// a single copy-on-write pass rather than one Delete per expired key.
+func (em *EfficientMapWithTTL[K, V]) sweepOnce() {
+	now := time.Now().UnixNano()
+	em.m.mutex.Lock()
+	defer em.m.mutex.Unlock()
+	old := *em.m.m.Load()
+	fresh := make(map[K]ttlEntry[V], len(old))
+	for k, e := range old {
+		if !e.expired(now) {
+			fresh[k] = e
+		}
+	}
+	em.m.m.Store(&fresh)
+}
+
+// AtomicMapWithTTL adds expiring keys on top of AtomicMap, the same way
+// EfficientMapWithTTL does for EfficientMap.
+type AtomicMapWithTTL[K comparable, V any] struct {
+	m         *AtomicMap[K, ttlEntry[V]]
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewAtomicMapWithTTL[K comparable, V any](sweepInterval time.Duration) *AtomicMapWithTTL[K, V] {
+	am := &AtomicMapWithTTL[K, V]{m: NewAtomicMap[K, ttlEntry[V]](), stop: make(chan struct{})}
+	go am.sweepLoop(sweepInterval)
+	return am
+}
+
+func (am *AtomicMapWithTTL[K, V]) Get(key K) (V, bool) {
+	e, ok := am.m.Get(key)
+	if !ok || e.expired(time.Now().UnixNano()) {
+		var zero V
+		return zero, false
+	}
+	return e.val, true
+}
+
+func (am *AtomicMapWithTTL[K, V]) Put(key K, val V) {
+	am.put(key, ttlEntry[V]{val: val})
+}
+
+func (am *AtomicMapWithTTL[K, V]) PutWithTTL(key K, val V, ttl time.Duration) {
+	am.put(key, ttlEntry[V]{val: val, expiresAt: time.Now().Add(ttl).UnixNano()})
+}
+
+// put stores entry for key, lazily evicting any other already-expired
+// entries during the same copy-on-write rebuild Put/PutWithTTL already pays
+// for; see EfficientMapWithTTL.put.
+func (am *AtomicMapWithTTL[K, V]) put(key K, entry ttlEntry[V]) {
+	now := time.Now().UnixNano()
+	am.m.mutex.Lock()
+	defer am.m.mutex.Unlock()
+	old := am.m.av.Load().(map[K]ttlEntry[V])
+	fresh := make(map[K]ttlEntry[V], len(old)+1)
+	for k, e := range old {
+		if k == key || !e.expired(now) {
+			fresh[k] = e
+		}
+	}
+	fresh[key] = entry
+	am.m.av.Store(fresh)
+}
+
+func (am *AtomicMapWithTTL[K, V]) Delete(key K) { am.m.Delete(key) }
+
+func (am *AtomicMapWithTTL[K, V]) Close() {
+	am.closeOnce.Do(func() { close(am.stop) })
+}
+
+func (am *AtomicMapWithTTL[K, V]) sweepLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			am.sweepOnce()
+		case <-am.stop:
+			return
+		}
+	}
+}
+
+func (am *AtomicMapWithTTL[K, V]) sweepOnce() {
+	now := time.Now().UnixNano()
+	am.m.mutex.Lock()
+	defer am.m.mutex.Unlock()
+	old := am.m.av.Load().(map[K]ttlEntry[V])
+	fresh := make(map[K]ttlEntry[V], len(old))
+	for k, e := range old {
+		if !e.expired(now) {
+			fresh[k] = e
+		}
+	}
+	am.m.av.Store(fresh)
+}
+
+// SyncMapWithTTL adds expiring keys on top of SyncMap. Unlike the
+// copy-on-write variants, expired keys are swept with a targeted Delete per
+// key instead of a full rebuild, since sync.Map already supports fine-grained
+// deletes.
+type SyncMapWithTTL[K comparable, V any] struct {
+	m         *SyncMap[K, ttlEntry[V]]
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewSyncMapWithTTL[K comparable, V any](sweepInterval time.Duration) *SyncMapWithTTL[K, V] {
+	sm := &SyncMapWithTTL[K, V]{m: NewSyncMap[K, ttlEntry[V]](), stop: make(chan struct{})}
+	go sm.sweepLoop(sweepInterval)
+	return sm
+}
+
+func (sm *SyncMapWithTTL[K, V]) Get(key K) (V, bool) {
+	e, ok := sm.m.Get(key)
+	if !ok || e.expired(time.Now().UnixNano()) {
+		var zero V
+		return zero, false
+	}
+	return e.val, true
+}
+
+func (sm *SyncMapWithTTL[K, V]) Put(key K, val V) {
+	sm.put(key, ttlEntry[V]{val: val})
+}
+
+func (sm *SyncMapWithTTL[K, V]) PutWithTTL(key K, val V, ttl time.Duration) {
+	sm.put(key, ttlEntry[V]{val: val, expiresAt: time.Now().Add(ttl).UnixNano()})
+}
+
+// put stores entry for key, then opportunistically evicts other already-
+// expired entries the same way sweepOnce does, so expired entries don't
+// linger indefinitely between sweeps (or forever if Close stopped the sweep
+// goroutine); see EfficientMapWithTTL.put.
+func (sm *SyncMapWithTTL[K, V]) put(key K, entry ttlEntry[V]) {
+	sm.m.Put(key, entry)
+	sm.sweepOnce()
+}
+
+func (sm *SyncMapWithTTL[K, V]) Delete(key K) { sm.m.Delete(key) }
+
+func (sm *SyncMapWithTTL[K, V]) Close() {
+	sm.closeOnce.Do(func() { close(sm.stop) })
+}
+
+func (sm *SyncMapWithTTL[K, V]) sweepLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sm.sweepOnce()
+		case <-sm.stop:
+			return
+		}
+	}
+}
+
+func (sm *SyncMapWithTTL[K, V]) sweepOnce() {
+	now := time.Now().UnixNano()
+	sm.m.Range(func(key K, e ttlEntry[V]) bool {
+		if e.expired(now) {
+			sm.m.Delete(key)
+		}
+		return true
+	})
+}
+
+// ************************** U N I T   T E S T S **************************
+
+// TestSyncMapUpdateOrStoreAtomicAgainstPut reproduces a concurrent Put
+// landing between UpdateOrStore's read and its final store. Mapper's
+// UpdateOrStore contract promises to atomically compute-and-store against
+// every other writer, so a Put racing it must never be silently clobbered.
+func TestSyncMapUpdateOrStoreAtomicAgainstPut(t *testing.T) {
+	sm := NewSyncMap[string, int]()
+	sm.Put("k", 0)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		sm.UpdateOrStore("k", func(old int, existed bool) int { return old + 1 })
+	}()
+	go func() {
+		defer wg.Done()
+		sm.Put("k", 100)
+	}()
+	wg.Wait()
+
+	// With UpdateOrStore and Put serialized against each other, the only
+	// possible outcomes are "UpdateOrStore then Put" (100) or "Put then
+	// UpdateOrStore" (101); Put's write must never be silently dropped (1).
+	v, _ := sm.Get("k")
+	if v != 100 && v != 101 {
+		t.Fatalf("Get(\"k\") = %v, want 100 or 101 (got %v: Put's write was silently dropped)", v, v)
+	}
+}
+
+func TestAtomicPtrMapStoreLoadDelete(t *testing.T) {
+	m := NewAtomicPtrMap[string, int](FNVHashString)
+	if _, ok := m.Get("a"); ok {
+		t.Fatalf("Get on empty map: got ok=true")
+	}
+	m.Store("a", 1)
+	if v, ok := m.Get("a"); !ok || v != 1 {
+		t.Fatalf("Get after Store: got (%v, %v), want (1, true)", v, ok)
+	}
+	m.Store("a", 2)
+	if v, ok := m.Get("a"); !ok || v != 2 {
+		t.Fatalf("Get after overwrite: got (%v, %v), want (2, true)", v, ok)
+	}
+	m.Delete("a")
+	if _, ok := m.Get("a"); ok {
+		t.Fatalf("Get after Delete: got ok=true")
+	}
+	m.Delete("a") // deleting an already-deleted key must not panic
+}
+
+func TestAtomicPtrMapLoadOrStore(t *testing.T) {
+	m := NewAtomicPtrMap[string, int](FNVHashString)
+	actual, loaded := m.LoadOrStore("a", 1)
+	if loaded || actual != 1 {
+		t.Fatalf("first LoadOrStore: got (%v, %v), want (1, false)", actual, loaded)
+	}
+	actual, loaded = m.LoadOrStore("a", 2)
+	if !loaded || actual != 1 {
+		t.Fatalf("second LoadOrStore: got (%v, %v), want (1, true)", actual, loaded)
+	}
+}
+
+func TestAtomicPtrMapUpdateOrStore(t *testing.T) {
+	m := NewAtomicPtrMap[string, int](FNVHashString)
+	got := m.UpdateOrStore("a", func(old int, existed bool) int {
+		if existed {
+			t.Fatalf("first UpdateOrStore: existed=true for a fresh key")
+		}
+		return old + 1
+	})
+	if got != 1 {
+		t.Fatalf("first UpdateOrStore: got %v, want 1", got)
+	}
+	got = m.UpdateOrStore("a", func(old int, existed bool) int {
+		if !existed || old != 1 {
+			t.Fatalf("second UpdateOrStore: got (old=%v, existed=%v), want (1, true)", old, existed)
+		}
+		return old + 1
+	})
+	if got != 2 {
+		t.Fatalf("second UpdateOrStore: got %v, want 2", got)
+	}
+}
+
+func TestAtomicPtrMapRange(t *testing.T) {
+	m := NewAtomicPtrMap[string, int](FNVHashString)
+	want := map[string]int{"a": 1, "b": 2, "c": 3}
+	for k, v := range want {
+		m.Store(k, v)
+	}
+	m.Delete("b")
+	delete(want, "b")
+
+	got := map[string]int{}
+	m.Range(func(k string, v int) bool {
+		got[k] = v
+		return true
+	})
+	if len(got) != len(want) {
+		t.Fatalf("Range visited %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Fatalf("Range missed %q: got %v, want %v", k, got[k], v)
+		}
+	}
+
+	seen := 0
+	m.Range(func(k string, v int) bool {
+		seen++
+		return false
+	})
+	if seen != 1 {
+		t.Fatalf("Range did not stop on f returning false: saw %d entries", seen)
+	}
+}
+
+// TestAtomicPtrMapStoreDeleteChurnGrows reproduces a store/delete churn
+// workload that keeps the live entry count near zero while leaving a
+// tombstone behind on every delete. growLocked must key off occupied slots
+// (live + tombstoned), not live count, or the table fills with tombstones:
+// Store silently drops the write once the probe loop runs out of slots, and
+// LoadOrStore/UpdateOrStore panic with "table unexpectedly full".
+func TestAtomicPtrMapStoreDeleteChurnGrows(t *testing.T) {
+	m := NewAtomicPtrMap[int, int](func(k int) uint32 { return uint32(k) })
+	for i := 0; i < 1000; i++ {
+		m.Store(i, i)
+		m.Delete(i)
+	}
+	// Every key was deleted; none should still be loadable.
+	for i := 0; i < 1000; i++ {
+		if _, ok := m.Get(i); ok {
+			t.Fatalf("Get(%d) after delete: got ok=true", i)
+		}
+	}
+	// The table must still have room: a fresh Store must not be silently
+	// dropped, and LoadOrStore must not panic.
+	m.Store(-1, 42)
+	if v, ok := m.Get(-1); !ok || v != 42 {
+		t.Fatalf("Store after churn: Get(-1) = (%v, %v), want (42, true)", v, ok)
+	}
+	if actual, loaded := m.LoadOrStore(-2, 7); loaded || actual != 7 {
+		t.Fatalf("LoadOrStore after churn: got (%v, %v), want (7, false)", actual, loaded)
+	}
+}
+
+func TestHybridMapStoreLoadDelete(t *testing.T) {
+	h := NewHybridMap[string, int]()
+	if _, ok := h.Get("a"); ok {
+		t.Fatalf("Get on empty map: got ok=true")
+	}
+	h.Put("a", 1)
+	if v, ok := h.Get("a"); !ok || v != 1 {
+		t.Fatalf("Get after Put: got (%v, %v), want (1, true)", v, ok)
+	}
+	h.Put("a", 2)
+	if v, ok := h.Get("a"); !ok || v != 2 {
+		t.Fatalf("Get after overwrite: got (%v, %v), want (2, true)", v, ok)
+	}
+	h.Delete("a")
+	if _, ok := h.Get("a"); ok {
+		t.Fatalf("Get after Delete: got ok=true")
+	}
+	h.Delete("a") // deleting an already-deleted key must not panic
+}
+
+func TestHybridMapLoadOrStore(t *testing.T) {
+	h := NewHybridMap[string, int]()
+	actual, loaded := h.LoadOrStore("a", 1)
+	if loaded || actual != 1 {
+		t.Fatalf("first LoadOrStore: got (%v, %v), want (1, false)", actual, loaded)
+	}
+	actual, loaded = h.LoadOrStore("a", 2)
+	if !loaded || actual != 1 {
+		t.Fatalf("second LoadOrStore: got (%v, %v), want (1, true)", actual, loaded)
+	}
+}
+
+func TestHybridMapUpdateOrStore(t *testing.T) {
+	h := NewHybridMap[string, int]()
+	got := h.UpdateOrStore("a", func(old int, existed bool) int {
+		if existed {
+			t.Fatalf("first UpdateOrStore: existed=true for a fresh key")
+		}
+		return old + 1
+	})
+	if got != 1 {
+		t.Fatalf("first UpdateOrStore: got %v, want 1", got)
+	}
+	got = h.UpdateOrStore("a", func(old int, existed bool) int {
+		if !existed || old != 1 {
+			t.Fatalf("second UpdateOrStore: got (old=%v, existed=%v), want (1, true)", old, existed)
+		}
+		return old + 1
+	})
+	if got != 2 {
+		t.Fatalf("second UpdateOrStore: got %v, want 2", got)
+	}
+}
+
+func TestHybridMapRange(t *testing.T) {
+	h := NewHybridMap[string, int]()
+	want := map[string]int{"a": 1, "b": 2, "c": 3}
+	for k, v := range want {
+		h.Put(k, v)
+	}
+	h.Delete("b")
+	delete(want, "b")
+
+	got := map[string]int{}
+	h.Range(func(k string, v int) bool {
+		got[k] = v
+		return true
+	})
+	if len(got) != len(want) {
+		t.Fatalf("Range visited %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Fatalf("Range missed %q: got %v, want %v", k, got[k], v)
+		}
+	}
+}
+
+// TestHybridMapDeletePromotesDirty reproduces a delete-heavy workload that
+// never misses on Get. Delete must record a miss the same way Get and
+// LoadOrStore do (matching sync.Map's LoadAndDelete), or dirty never
+// accumulates enough misses to promote into read and every key stays on the
+// slow, mutex-guarded path forever.
+func TestHybridMapDeletePromotesDirty(t *testing.T) {
+	h := NewHybridMap[string, int]()
+	h.Put("a", 1)
+	// Put on a fresh key builds dirty (via dirtyLocked) and marks read as
+	// amended; LoadOrStore on another fresh key adds it to dirty. Neither
+	// records a miss.
+	h.LoadOrStore("b", 2)
+	if h.dirty == nil {
+		t.Fatalf("dirty not built by Put/LoadOrStore")
+	}
+	want := len(h.dirty)
+	for i := 0; i < want; i++ {
+		h.Delete("a")
+	}
+	if h.dirty != nil {
+		t.Fatalf("dirty was not promoted into read after %d delete misses", want)
+	}
+}
+
+// TestHybridMapUpdateOrStorePromotesDirty reproduces an UpdateOrStore-heavy
+// workload against a dirty-only key. UpdateOrStore's dirty-hit branch must
+// record a miss the same way Get/LoadOrStore/Delete do, or dirty never
+// accumulates enough misses to promote into read and that key (and the
+// whole map) stays on the slow, mutex-guarded path forever.
+func TestHybridMapUpdateOrStorePromotesDirty(t *testing.T) {
+	h := NewHybridMap[string, int]()
+	h.Put("a", 1)
+	// Put on a fresh key builds dirty (via dirtyLocked) and marks read as
+	// amended; LoadOrStore on another fresh key adds it to dirty. Neither
+	// records a miss.
+	h.LoadOrStore("b", 2)
+	if h.dirty == nil {
+		t.Fatalf("dirty not built by Put/LoadOrStore")
+	}
+	want := len(h.dirty)
+	incr := func(old int, existed bool) int { return old + 1 }
+	for i := 0; i < want; i++ {
+		h.UpdateOrStore("a", incr)
+	}
+	if h.dirty != nil {
+		t.Fatalf("dirty was not promoted into read after %d UpdateOrStore misses", want)
+	}
+}
+
+func TestEfficientMapWithTTLGetExpired(t *testing.T) {
+	em := NewEfficientMapWithTTL[string, int](time.Hour)
+	defer em.Close()
+	em.PutWithTTL("a", 1, time.Nanosecond)
+	waitUntil(t, func() bool {
+		_, ok := em.Get("a")
+		return !ok
+	})
+}
+
+func TestEfficientMapWithTTLPutEvictsExpired(t *testing.T) {
+	em := NewEfficientMapWithTTL[string, int](time.Hour)
+	defer em.Close()
+	em.PutWithTTL("a", 1, time.Nanosecond)
+	waitUntil(t, func() bool {
+		_, ok := em.Get("a")
+		return !ok
+	})
+	// A later Put for an unrelated key must lazily evict "a" from the
+	// underlying map rather than leaving it around until the next sweep.
+	em.Put("b", 2)
+	if _, ok := em.m.Get("a"); ok {
+		t.Fatalf("Put did not lazily evict the expired entry for \"a\"")
+	}
+}
+
+func TestEfficientMapWithTTLSweepRemovesExpired(t *testing.T) {
+	em := NewEfficientMapWithTTL[string, int](time.Millisecond)
+	defer em.Close()
+	em.PutWithTTL("a", 1, time.Nanosecond)
+	waitUntil(t, func() bool {
+		_, ok := em.m.Get("a")
+		return !ok
+	})
+}
+
+func TestEfficientMapWithTTLUsableAfterClose(t *testing.T) {
+	em := NewEfficientMapWithTTL[string, int](time.Millisecond)
+	em.Close()
+	em.Close() // Close must be safe to call more than once.
+	em.Put("a", 1)
+	if v, ok := em.Get("a"); !ok || v != 1 {
+		t.Fatalf("Get after Close: got (%v, %v), want (1, true)", v, ok)
+	}
+}
+
+// waitUntil polls cond until it returns true or a short deadline passes,
+// failing the test on timeout. Used to observe effects of the background
+// sweep goroutine without a fixed, flaky sleep.
+func waitUntil(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("condition not met within timeout")
+		}
+		runtime.Gosched()
+	}
 }
 
 // ************************** B E N C H M A R K **************************
@@ -93,12 +1570,16 @@ func (em *EfficientMap) Put(key string, val interface{}) {
 const getToPutRatio int32 = 20000 // How many `Get` calls against `Put` call.
 const size int = 100              // Size of Map.
 
-var am = NewAtomicMap()
-var em = NewEfficientMap()
-var sm = NewSyncMap()
+var am = NewAtomicMap[string, string]()
+var em = NewEfficientMap[string, string]()
+var sm = NewSyncMap[string, string]()
+var shardedEm = NewShardedEfficientMap[string, string](0, FNVHashString)
+var apm = NewAtomicPtrMap[string, string](FNVHashString)
+var apmSharded = NewAtomicPtrMapSharded[string, string](0, FNVHashString)
+var hybrid = NewHybridMap[string, string]()
 
 func init() {
-	f := func(m Mapper) {
+	f := func(m Mapper[string, string]) {
 		for i := 0; i < size; i++ {
 			m.Put(strconv.Itoa(i), strconv.Itoa(i))
 		}
@@ -106,6 +1587,10 @@ func init() {
 	f(am)
 	f(em)
 	f(sm)
+	f(shardedEm)
+	f(apm)
+	f(apmSharded)
+	f(hybrid)
 }
 
 func BenchmarkAtomicMap(b *testing.B) {
@@ -117,11 +1602,11 @@ func BenchmarkEfficientMap(b *testing.B) {
 func BenchmarkSyncMap(b *testing.B) {
 	bench(b, sm)
 }
-func bench(b *testing.B, m Mapper) {
+func bench(b *testing.B, m Mapper[string, string]) {
 	benchFixedThreads(b, m)
 	// benchVariableThreads(b, m)
 }
-func benchFixedThreads(b *testing.B, m Mapper) {
+func benchFixedThreads(b *testing.B, m Mapper[string, string]) {
 	b.ReportAllocs()
 	wg := sync.WaitGroup{}
 	for i := 0; i < 24; i++ { //Fixed threads
@@ -144,7 +1629,7 @@ func benchFixedThreads(b *testing.B, m Mapper) {
 	wg.Wait()
 }
 
-func benchVariableThreads(b *testing.B, m Mapper) {
+func benchVariableThreads(b *testing.B, m Mapper[string, string]) {
 	b.ReportAllocs()
 	wg := sync.WaitGroup{}
 	for i := 0; i < b.N; i++ {
@@ -166,3 +1651,121 @@ func benchVariableThreads(b *testing.B, m Mapper) {
 	}
 	wg.Wait()
 }
+
+// ************************** F I X E D K E Y S _ 1 0 P E R C E N T W R I T E S **************************
+// Modeled on gvisor's AtomicPtrMap benchmarks: a fixed key set shared by all
+// goroutines with 10% writes, showing how sharding parallelizes writers and
+// shrinks each EfficientMap copy to size/shards entries.
+
+func BenchmarkAtomicMapFixedKeys10PercentWrites(b *testing.B) {
+	benchFixedKeysWrites(b, am, 10)
+}
+func BenchmarkEfficientMapFixedKeys10PercentWrites(b *testing.B) {
+	benchFixedKeysWrites(b, em, 10)
+}
+func BenchmarkSyncMapFixedKeys10PercentWrites(b *testing.B) {
+	benchFixedKeysWrites(b, sm, 10)
+}
+func BenchmarkShardedEfficientMapFixedKeys10PercentWrites(b *testing.B) {
+	benchFixedKeysWrites(b, shardedEm, 10)
+}
+
+// ************************** S I X - W A Y   W R I T E   R A T I O   B E N C H M A R K S **************************
+// Compares all six implementations (AtomicMap, EfficientMap, SyncMap,
+// ShardedEfficientMap, AtomicPtrMap and AtomicPtrMapSharded) at write ratios
+// of 1%, 10% and 50% over a fixed key set, matching the workload shape that
+// shows CoW losing its lead as the write ratio rises.
+
+func BenchmarkAtomicMapFixedKeys1PercentWrites(b *testing.B)    { benchFixedKeysWrites(b, am, 100) }
+func BenchmarkEfficientMapFixedKeys1PercentWrites(b *testing.B) { benchFixedKeysWrites(b, em, 100) }
+func BenchmarkSyncMapFixedKeys1PercentWrites(b *testing.B)      { benchFixedKeysWrites(b, sm, 100) }
+func BenchmarkShardedEfficientMapFixedKeys1PercentWrites(b *testing.B) {
+	benchFixedKeysWrites(b, shardedEm, 100)
+}
+func BenchmarkAtomicPtrMapFixedKeys1PercentWrites(b *testing.B) { benchFixedKeysWrites(b, apm, 100) }
+func BenchmarkAtomicPtrMapShardedFixedKeys1PercentWrites(b *testing.B) {
+	benchFixedKeysWrites(b, apmSharded, 100)
+}
+
+func BenchmarkAtomicPtrMapFixedKeys10PercentWrites(b *testing.B) { benchFixedKeysWrites(b, apm, 10) }
+func BenchmarkAtomicPtrMapShardedFixedKeys10PercentWrites(b *testing.B) {
+	benchFixedKeysWrites(b, apmSharded, 10)
+}
+
+func BenchmarkAtomicMapFixedKeys50PercentWrites(b *testing.B)    { benchFixedKeysWrites(b, am, 2) }
+func BenchmarkEfficientMapFixedKeys50PercentWrites(b *testing.B) { benchFixedKeysWrites(b, em, 2) }
+func BenchmarkSyncMapFixedKeys50PercentWrites(b *testing.B)      { benchFixedKeysWrites(b, sm, 2) }
+func BenchmarkShardedEfficientMapFixedKeys50PercentWrites(b *testing.B) {
+	benchFixedKeysWrites(b, shardedEm, 2)
+}
+func BenchmarkAtomicPtrMapFixedKeys50PercentWrites(b *testing.B) { benchFixedKeysWrites(b, apm, 2) }
+func BenchmarkAtomicPtrMapShardedFixedKeys50PercentWrites(b *testing.B) {
+	benchFixedKeysWrites(b, apmSharded, 2)
+}
+
+// benchFixedKeysWrites drives m with a fixed key set (size keys) where 1/writeFraction
+// of operations are writes and the rest are reads.
+func benchFixedKeysWrites(b *testing.B, m Mapper[string, string], writeFraction int32) {
+	b.ReportAllocs()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 24; i++ { //Fixed threads
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < b.N; n++ {
+				v := strconv.Itoa(rand.Intn(size)) // Fixed key set
+				if rand.Int31n(writeFraction) == 0 {
+					m.Put(v, v)
+				} else {
+					v2, ok := m.Get(v)
+					if rand.Int31n(100) > 100 { //Fooling compiler
+						fmt.Println("Never written", v2, ok)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// ************************** H Y B R I D   C R O S S O V E R   B E N C H M A R K S **************************
+// Compares EfficientMap's full-copy Put against HybridMap's amortized promote
+// at write ratios of 1/100, 1/1000 and 1/20000 (the repo's original
+// getToPutRatio) to show where the hybrid's amortized O(1) Put starts
+// beating pure copy-on-write.
+
+func BenchmarkEfficientMapGetToPutRatio100(b *testing.B)  { benchGetToPutRatio(b, em, 100) }
+func BenchmarkHybridMapGetToPutRatio100(b *testing.B)     { benchGetToPutRatio(b, hybrid, 100) }
+func BenchmarkEfficientMapGetToPutRatio1000(b *testing.B) { benchGetToPutRatio(b, em, 1000) }
+func BenchmarkHybridMapGetToPutRatio1000(b *testing.B)    { benchGetToPutRatio(b, hybrid, 1000) }
+func BenchmarkEfficientMapGetToPutRatio20000(b *testing.B) {
+	benchGetToPutRatio(b, em, getToPutRatio)
+}
+func BenchmarkHybridMapGetToPutRatio20000(b *testing.B) {
+	benchGetToPutRatio(b, hybrid, getToPutRatio)
+}
+
+// benchGetToPutRatio mirrors benchFixedThreads but over a fixed key set, with
+// ratio `Get` calls against one `Put` call on average.
+func benchGetToPutRatio(b *testing.B, m Mapper[string, string], ratio int32) {
+	b.ReportAllocs()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 24; i++ { //Fixed threads
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < b.N; n++ {
+				v := strconv.Itoa(rand.Intn(size)) // Fixed key set
+				if rand.Int31n(ratio+1) == 0 {
+					m.Put(v, v)
+				} else {
+					v2, ok := m.Get(v)
+					if rand.Int31n(100) > 100 { //Fooling compiler
+						fmt.Println("Never written", v2, ok)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}